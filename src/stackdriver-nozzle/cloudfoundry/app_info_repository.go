@@ -17,12 +17,22 @@
 package cloudfoundry
 
 import (
-	"github.com/cloudfoundry-community/go-cfclient"
+	"container/list"
+	"context"
+	"expvar"
+	"sync"
 	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/provider"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
 )
 
-// AppInfoRepository represents a Cloud Foundry application's information.
+// AppInfoRepository represents a Cloud Foundry application's information. It
+// embeds provider.Provider so callers can Run/Close it (to drive the
+// background refresher and shut it down) without an unsafe type assertion.
 type AppInfoRepository interface {
+	provider.Provider
 
 	// GetAppInfo gets the basic information for a CF application.
 	GetAppInfo(string) AppInfo
@@ -38,9 +48,41 @@ type AppInfo struct {
 	LastQueried time.Time
 }
 
+const (
+	// foreverTTL stands in for "never expire", preserving the historical
+	// meaning of a negative appMetadataCachePeriod.
+	foreverTTL = 100 * 365 * 24 * time.Hour
+
+	// negativeCacheTTLFraction is how much of appMetadataCachePeriod a
+	// not-found result is cached for, so a deleted app's GUID doesn't keep
+	// re-hitting the CF API on every firehose event but also doesn't linger
+	// as long as a confirmed-good entry.
+	negativeCacheTTLFraction = 0.1
+
+	// refreshAheadFraction controls how early the background refresher picks
+	// up an entry before it expires, e.g. 0.8 means "once 80% of its TTL has
+	// elapsed".
+	refreshAheadFraction = 0.8
+
+	refreshInterval = 30 * time.Second
+)
+
 // NewAppInfoRepository creates a new AppInfoRepository given a CF client.
-func NewAppInfoRepository(cfClient *cfclient.Client, appMetadataCachePeriod int) AppInfoRepository {
-	return &appInfoRepository{cfClient, map[string]AppInfo{}, appMetadataCachePeriod}
+// maxEntries bounds the size of the in-memory LRU cache; once it's full, the
+// least recently used entry is evicted to make room for a new one. Callers
+// should run its Run method in a goroutine to drive the background
+// refresher, and call Close when shutting down.
+func NewAppInfoRepository(cfClient *cfclient.Client, appMetadataCachePeriod int, maxEntries int) AppInfoRepository {
+	return &appInfoRepository{
+		cfClient:               cfClient,
+		appMetadataCachePeriod: appMetadataCachePeriod,
+		maxEntries:             maxEntries,
+		entries:                map[string]*list.Element{},
+		order:                  list.New(),
+		hits:                   publishCounter("appInfoRepository.cacheHits"),
+		misses:                 publishCounter("appInfoRepository.cacheMisses"),
+		evictions:              publishCounter("appInfoRepository.cacheEvictions"),
+	}
 }
 
 // NullAppInfoRepository creates a new AppInfoRepository with Go default values.
@@ -48,54 +90,240 @@ func NullAppInfoRepository() AppInfoRepository {
 	return &nullAppInfoRepository{}
 }
 
+// cacheEntry is the value stored in appInfoRepository's LRU list; it's a
+// negative entry (found == false) when the most recent CF lookup for guid
+// came back not-found, so repeated lookups of a deleted app's GUID don't
+// re-hit the CF API on every firehose event.
+type cacheEntry struct {
+	guid      string
+	info      AppInfo
+	found     bool
+	expiresAt time.Time
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return now.After(e.expiresAt)
+}
+
 type appInfoRepository struct {
 	cfClient               *cfclient.Client
-	cache                  map[string]AppInfo
 	appMetadataCachePeriod int
+	maxEntries             int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits      *telemetry.Counter
+	misses    *telemetry.Counter
+	evictions *telemetry.Counter
 }
 
-func (air *appInfoRepository) GetAppInfo(guid string) AppInfo {
-	// Handle cacheable configurations
-	if air.appMetadataCachePeriod != 0 {
-		appInfo, ok := air.cache[guid]
-
-		if ok {
-			if air.appMetadataCachePeriod > 0 {
-				metadataReadTime := appInfo.LastQueried
-				// elapsedTime is in seconds, time.Since returns a duration, so we need to convert to seconds
-				elapsedTime := time.Since(metadataReadTime).Seconds()
-
-				if elapsedTime < float64(air.appMetadataCachePeriod) {
-					return appInfo
-				}
-			} else {
-				return appInfo
-			}
+// Init satisfies provider.Provider. appInfoRepository has nothing to
+// prepare before it can start serving GetAppInfo; connectivity to the CF
+// API is validated lazily on the first lookup, same as before.
+func (air *appInfoRepository) Init(ctx context.Context, registry []*expvar.KeyValue) error {
+	return nil
+}
+
+// Run satisfies provider.Provider: it drives the background refresher until
+// ctx is cancelled. Callers should run it in a goroutine.
+func (air *appInfoRepository) Run(ctx context.Context) error {
+	if air.appMetadataCachePeriod == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			air.refreshExpiringEntries()
+		case <-ctx.Done():
+			return nil
 		}
 	}
+}
+
+// Close satisfies provider.Provider. The refresher goroutine is stopped by
+// cancelling the context passed to Run, so Close has nothing left to do.
+func (air *appInfoRepository) Close() error {
+	return nil
+}
+
+// GetAppInfo is safe to call from many goroutines at once; the firehose sink
+// fans events out across a worker pool, so this is on the hot path.
+func (air *appInfoRepository) GetAppInfo(guid string) AppInfo {
+	if air.appMetadataCachePeriod == 0 {
+		return air.QueryCfForMetadata(guid)
+	}
+
+	if entry, ok := air.get(guid); ok {
+		air.hits.Add(1)
+		return entry.info
+	}
 
+	air.misses.Add(1)
 	return air.QueryCfForMetadata(guid)
 }
 
+// get returns the cached entry for guid, including a not-yet-expired
+// negative entry (found == false, info is the zero AppInfo) so a repeatedly
+// looked-up deleted app's GUID is served from cache instead of re-hitting
+// the CF API on every firehose event.
+func (air *appInfoRepository) get(guid string) (*cacheEntry, bool) {
+	air.mu.Lock()
+	defer air.mu.Unlock()
+
+	elem, ok := air.entries[guid]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if entry.expired(time.Now()) {
+		air.removeLocked(elem)
+		return nil, false
+	}
+
+	air.order.MoveToFront(elem)
+	return entry, true
+}
+
+// QueryCfForMetadata fetches guid from the CF API and caches the result,
+// positive or negative, before returning it.
 func (air *appInfoRepository) QueryCfForMetadata(guid string) AppInfo {
-	var appInfo AppInfo
 	app, err := air.cfClient.AppByGuid(guid)
-	if err == nil {
-		appInfo := AppInfo{
-			AppName:     app.Name,
-			SpaceGUID:   app.SpaceData.Entity.Guid,
-			SpaceName:   app.SpaceData.Entity.Name,
-			OrgGUID:     app.SpaceData.Entity.OrgData.Entity.Guid,
-			OrgName:     app.SpaceData.Entity.OrgData.Entity.Name,
-			LastQueried: time.Now(),
-		}
-		air.cache[guid] = appInfo
+	if err != nil {
+		air.put(guid, AppInfo{}, false)
+		return AppInfo{}
 	}
+
+	appInfo := AppInfo{
+		AppName:     app.Name,
+		SpaceGUID:   app.SpaceData.Entity.Guid,
+		SpaceName:   app.SpaceData.Entity.Name,
+		OrgGUID:     app.SpaceData.Entity.OrgData.Entity.Guid,
+		OrgName:     app.SpaceData.Entity.OrgData.Entity.Name,
+		LastQueried: time.Now(),
+	}
+	air.put(guid, appInfo, true)
 	return appInfo
 }
 
+func (air *appInfoRepository) ttl() time.Duration {
+	if air.appMetadataCachePeriod < 0 {
+		return foreverTTL
+	}
+	return time.Duration(air.appMetadataCachePeriod) * time.Second
+}
+
+func (air *appInfoRepository) put(guid string, info AppInfo, found bool) {
+	ttl := air.ttl()
+	if !found {
+		ttl = time.Duration(float64(ttl) * negativeCacheTTLFraction)
+	}
+
+	entry := &cacheEntry{
+		guid:      guid,
+		info:      info,
+		found:     found,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	air.mu.Lock()
+	defer air.mu.Unlock()
+
+	if elem, ok := air.entries[guid]; ok {
+		elem.Value = entry
+		air.order.MoveToFront(elem)
+		return
+	}
+
+	elem := air.order.PushFront(entry)
+	air.entries[guid] = elem
+
+	if air.maxEntries > 0 && len(air.entries) > air.maxEntries {
+		air.evictOldestLocked()
+	}
+}
+
+// evictOldestLocked removes the least recently used entry. Callers must hold
+// air.mu.
+func (air *appInfoRepository) evictOldestLocked() {
+	oldest := air.order.Back()
+	if oldest == nil {
+		return
+	}
+	air.removeLocked(oldest)
+	air.evictions.Add(1)
+}
+
+// removeLocked removes elem from both the LRU list and the index. Callers
+// must hold air.mu.
+func (air *appInfoRepository) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	delete(air.entries, entry.guid)
+	air.order.Remove(elem)
+}
+
+// refreshExpiringEntries proactively refetches entries that are about to
+// expire, so a busy app's metadata is rarely served from a fully-expired
+// (and therefore blocking) cache entry. It's called by Run on a timer.
+func (air *appInfoRepository) refreshExpiringEntries() {
+	refreshWindow := time.Duration(float64(air.ttl()) * (1 - refreshAheadFraction))
+	now := time.Now()
+
+	var stale []string
+	air.mu.Lock()
+	for guid, elem := range air.entries {
+		entry := elem.Value.(*cacheEntry)
+		if entry.found && now.Add(refreshWindow).After(entry.expiresAt) {
+			stale = append(stale, guid)
+		}
+	}
+	air.mu.Unlock()
+
+	for _, guid := range stale {
+		air.QueryCfForMetadata(guid)
+	}
+}
+
+// publishCounter registers a telemetry.Counter under the existing telemetry
+// registry. Repositories are expected to be constructed once per process,
+// but this tolerates re-registration (e.g. in tests) rather than panicking.
+func publishCounter(name string) *telemetry.Counter {
+	counter := telemetry.NewCounter(nil)
+	func() {
+		defer func() { recover() }()
+		expvar.Publish(name, counter)
+	}()
+	return counter
+}
+
 type nullAppInfoRepository struct{}
 
+// Init satisfies provider.Provider. nullAppInfoRepository has nothing to
+// prepare.
+func (nair *nullAppInfoRepository) Init(ctx context.Context, registry []*expvar.KeyValue) error {
+	return nil
+}
+
+// Run satisfies provider.Provider. nullAppInfoRepository has no background
+// work, so Run just blocks until the nozzle shuts down.
+func (nair *nullAppInfoRepository) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Close satisfies provider.Provider. nullAppInfoRepository holds no
+// resources that need releasing.
+func (nair *nullAppInfoRepository) Close() error {
+	return nil
+}
+
 func (nair *nullAppInfoRepository) GetAppInfo(guid string) AppInfo {
 	return AppInfo{}
 }
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// NewHTTPCloudEventEmitter returns a CloudEventEmitter that POSTs each
+// CloudEvent as structured-mode JSON to endpoint, e.g. a Knative broker or
+// Argo Events webhook.
+func NewHTTPCloudEventEmitter(client *http.Client, endpoint string) CloudEventEmitter {
+	return &httpCloudEventEmitter{client: client, endpoint: endpoint}
+}
+
+type httpCloudEventEmitter struct {
+	client   *http.Client
+	endpoint string
+}
+
+func (e *httpCloudEventEmitter) Emit(event *CloudEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("cloudevent emitter: %s returned %s", e.endpoint, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const cloudEventsSpecVersion = "1.0"
+
+// CloudEvent is a CloudEvents v1.0 structured-mode JSON envelope. See
+// https://github.com/cloudevents/spec/blob/v1.0/spec.md for the field
+// definitions.
+type CloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Time            string                 `json:"time,omitempty"`
+	DataContentType string                 `json:"datacontenttype"`
+	Data            map[string]interface{} `json:"data"`
+}
+
+// CloudEventEmitter hands a CloudEvent off to whatever transport the
+// deployment has configured, e.g. an HTTP endpoint or a Kafka topic.
+type CloudEventEmitter interface {
+	Emit(event *CloudEvent) error
+}
+
+// NewCloudEventSink returns a Sink that translates each sonde Envelope into a
+// CloudEvents v1.0 structured envelope and hands it to emitter, letting
+// operators fan firehose data out to any CloudEvents-compatible consumer
+// (Knative, Argo Events, etc.) instead of being locked to Stackdriver Logging.
+func NewCloudEventSink(labelMaker LabelMaker, emitter CloudEventEmitter, newlineToken string, logger lager.Logger) Sink {
+	return &cloudEventSink{
+		labelMaker:   labelMaker,
+		emitter:      emitter,
+		newlineToken: newlineToken,
+		logger:       logger,
+	}
+}
+
+type cloudEventSink struct {
+	labelMaker   LabelMaker
+	emitter      CloudEventEmitter
+	newlineToken string
+	logger       lager.Logger
+}
+
+// Init satisfies provider.Provider. cloudEventSink has nothing to prepare
+// before it can start receiving envelopes.
+func (ces *cloudEventSink) Init(ctx context.Context, registry []*expvar.KeyValue) error {
+	return nil
+}
+
+// Run satisfies provider.Provider. cloudEventSink is driven by Receive calls
+// from the firehose consumer loop rather than a loop of its own, so Run just
+// blocks until the nozzle shuts down.
+func (ces *cloudEventSink) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Close satisfies provider.Provider. cloudEventSink holds no resources that
+// need releasing beyond its emitter, which the caller owns.
+func (ces *cloudEventSink) Close() error {
+	return nil
+}
+
+func (ces *cloudEventSink) Receive(envelope *events.Envelope) {
+	if envelope == nil {
+		// As with logSink, firehose sends a nil envelope alongside fatal
+		// errors (sometimes thousands of times in a row). Ignore it here too.
+		return
+	}
+
+	event := ces.parseEnvelope(envelope)
+	if err := ces.emitter.Emit(event); err != nil {
+		ces.logger.Error("error emitting CloudEvent", err, lager.Data{"type": event.Type})
+	}
+}
+
+func (ces *cloudEventSink) parseEnvelope(envelope *events.Envelope) *CloudEvent {
+	payload, _, _ := envelopeToPayload(envelope, ces.labelMaker, ces.logger, ces.newlineToken)
+
+	event := &CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              cloudEventID(envelope),
+		Source:          cloudEventSource(envelope),
+		Type:            cloudEventType(envelope),
+		DataContentType: "application/json",
+		Data:            payload,
+	}
+
+	if ts := envelope.GetTimestamp(); ts != 0 {
+		event.Time = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+
+	return event
+}
+
+// cloudEventSource identifies the CF component that emitted the envelope,
+// e.g. "/deployments/cf/origins/rep".
+func cloudEventSource(envelope *events.Envelope) string {
+	return fmt.Sprintf("/deployments/%s/origins/%s", envelope.GetDeployment(), envelope.GetOrigin())
+}
+
+// cloudEventType maps the sonde event type to a reverse-DNS CloudEvents type,
+// snake_casing its name, e.g. "org.cloudfoundry.firehose.log_message.v1".
+func cloudEventType(envelope *events.Envelope) string {
+	var name strings.Builder
+	for i, r := range envelope.GetEventType().String() {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			name.WriteByte('_')
+		}
+		name.WriteRune(r)
+	}
+	return fmt.Sprintf("org.cloudfoundry.firehose.%s.v1", strings.ToLower(name.String()))
+}
+
+// cloudEventID gives each event a reasonably unique identifier without
+// depending on a UUID library: the tuple of origin/deployment/index/timestamp
+// is unique enough for downstream consumers to dedupe on.
+func cloudEventID(envelope *events.Envelope) string {
+	return fmt.Sprintf("%s-%s-%s-%d", envelope.GetOrigin(), envelope.GetDeployment(), envelope.GetIndex(), envelope.GetTimestamp())
+}
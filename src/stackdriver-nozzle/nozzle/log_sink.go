@@ -17,7 +17,9 @@
 package nozzle
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"strings"
 
 	"cloud.google.com/go/logging"
@@ -44,6 +46,26 @@ type logSink struct {
 	logger       lager.Logger
 }
 
+// Init satisfies provider.Provider. logSink has nothing to prepare before it
+// can start receiving envelopes.
+func (ls *logSink) Init(ctx context.Context, registry []*expvar.KeyValue) error {
+	return nil
+}
+
+// Run satisfies provider.Provider. logSink is driven by Receive calls from
+// the firehose consumer loop rather than a loop of its own, so Run just
+// blocks until the nozzle shuts down.
+func (ls *logSink) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Close satisfies provider.Provider. logSink holds no resources that need
+// releasing beyond its LogAdapter, which the caller owns.
+func (ls *logSink) Close() error {
+	return nil
+}
+
 func (ls *logSink) Receive(envelope *events.Envelope) {
 	if envelope == nil {
 		// This happens when we get a fatal error from firehose,
@@ -69,10 +91,14 @@ func structToMap(obj interface{}) (map[string]interface{}, error) {
 	return unmarshaledMap, nil
 }
 
-func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
+// envelopeToPayload translates a sonde Envelope into the payload/labels/severity
+// triple that both the logging sink and the CloudEvents sink build on. Keeping
+// the translation here means any new destination sink only has to decide how
+// to wrap this payload, not how to read an Envelope.
+func envelopeToPayload(envelope *events.Envelope, labelMaker LabelMaker, logger lager.Logger, newlineToken string) (map[string]interface{}, map[string]string, logging.Severity) {
 	payload, err := structToMap(envelope) // better hope that's json
 	if err != nil {
-		ls.logger.Error("error parsing envelope", err)
+		logger.Error("error parsing envelope", err)
 	}
 
 	payload["eventType"] = envelope.GetEventType().String()
@@ -89,10 +115,10 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 		logMessage := envelope.GetLogMessage()
 		logMessageMap, err := structToMap(logMessage)
 		if err != nil {
-			ls.logger.Error("error parsing logMessage", err)
+			logger.Error("error parsing logMessage", err)
 		} else {
 			rawMessage := logMessage.GetMessage()
-			message := ls.parseMessage(rawMessage)
+			message := parseMessage(rawMessage, newlineToken)
 			var js map[string]interface{}
 			err = json.Unmarshal([]byte(rawMessage), &js)
 			if err == nil {
@@ -127,7 +153,7 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 		httpStartStop := envelope.GetHttpStartStop()
 		httpStartStopMap, err := structToMap(httpStartStop)
 		if err != nil {
-			ls.logger.Error("error parsing httpStartStop", err)
+			logger.Error("error parsing httpStartStop", err)
 		} else {
 			httpStartStopMap["method"] = httpStartStop.GetMethod().String()
 			httpStartStopMap["peerType"] = httpStartStop.GetPeerType().String()
@@ -136,7 +162,7 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 		}
 	}
 
-	labels := ls.labelMaker.LogLabels(envelope)
+	labels := labelMaker.LogLabels(envelope)
 	app := labels["applicationPath"]
 	if app != "" {
 		payload["serviceContext"] = map[string]interface{}{
@@ -144,19 +170,23 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 		}
 	}
 
-	log := messages.Log{
+	return payload, labels, severity
+}
+
+func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
+	payload, labels, severity := envelopeToPayload(envelope, ls.labelMaker, ls.logger, ls.newlineToken)
+
+	return messages.Log{
 		Payload:  payload,
 		Labels:   labels,
 		Severity: severity,
 	}
-
-	return log
 }
 
-func (ls *logSink) parseMessage(rawMessage []byte) string {
+func parseMessage(rawMessage []byte, newlineToken string) string {
 	message := string(rawMessage)
-	if ls.newlineToken != "" {
-		message = strings.Replace(message, ls.newlineToken, "\n", -1)
+	if newlineToken != "" {
+		message = strings.Replace(message, newlineToken, "\n", -1)
 	}
 	return message
 }
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package provider defines the common startup/shutdown lifecycle shared by
+// nozzle's long-running components (sinks, the AppInfoRepository, ...).
+package provider
+
+import (
+	"context"
+	"expvar"
+)
+
+// Provider is implemented by each long-running nozzle component so startup
+// failures (a blocked GCE metadata lookup, a denied ListMetricDescriptors
+// call, ...) are surfaced the same way everywhere instead of being done as a
+// side effect of construction and left for the caller to notice or not.
+type Provider interface {
+	// Init prepares the provider to run: detecting its environment,
+	// pre-registering metric descriptors, validating connectivity, etc.
+	// registry is the set of expvars published so far, for providers (like
+	// the telemetry sink) that need to know what they'll eventually report.
+	// Init should respect ctx's deadline rather than blocking indefinitely.
+	Init(ctx context.Context, registry []*expvar.KeyValue) error
+
+	// Run executes the provider's long-running work, if any, blocking until
+	// ctx is cancelled or a fatal error occurs. Providers with no ongoing
+	// work of their own simply block on ctx.Done().
+	Run(ctx context.Context) error
+
+	// Close releases any resources the provider is holding, e.g. open
+	// connections. It's safe to call even if Run was never started.
+	Close() error
+}
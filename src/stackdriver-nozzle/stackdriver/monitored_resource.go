@@ -0,0 +1,202 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// metadataTimeout bounds how long detectMonitoredResource waits on the GCE
+// metadata server. Without it, a nozzle running somewhere the metadata
+// server is unreachable (e.g. a misconfigured non-GCE host) would hang here
+// indefinitely instead of falling back to the "global" resource.
+const metadataTimeout = 2 * time.Second
+
+const kubernetesServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// resourceDetector tries to identify the environment nozzle is running in.
+// It returns ok == false when its environment isn't present, so
+// detectMonitoredResource can fall through to the next detector in the
+// table without every detector needing to know about the others.
+type resourceDetector func(ctx context.Context) (res *monitoredres.MonitoredResource, ok bool)
+
+// resourceDetectors is tried in order; the first one to report ok wins. New
+// environments can be supported by adding a detector here, without touching
+// detectMonitoredResource or any sink.
+var resourceDetectors = []resourceDetector{
+	detectGKEResource,
+	detectCFResource,
+	detectGCEResource,
+}
+
+// gceInstanceInfo is the subset of GCE metadata the GCE and GKE detectors
+// need; it's fetched on a goroutine so metadataTimeout can apply even though
+// the metadata package's own calls don't take a context.
+type gceInstanceInfo struct {
+	projectID, instanceID, zone string
+}
+
+func fetchGCEInstanceInfo(ctx context.Context) (*gceInstanceInfo, bool) {
+	done := make(chan *gceInstanceInfo, 1)
+	go func() {
+		if !metadata.OnGCE() {
+			done <- nil
+			return
+		}
+		projectID, err := metadata.ProjectID()
+		if err != nil {
+			done <- nil
+			return
+		}
+		instanceID, err := metadata.InstanceID()
+		if err != nil {
+			done <- nil
+			return
+		}
+		zone, err := metadata.Zone()
+		if err != nil {
+			done <- nil
+			return
+		}
+		done <- &gceInstanceInfo{projectID: projectID, instanceID: instanceID, zone: zone}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case info := <-done:
+		return info, info != nil
+	}
+}
+
+// fetchInstanceAttribute fetches a single GCE instance attribute on a
+// goroutine, same as fetchGCEInstanceInfo, so ctx's deadline bounds it even
+// though metadata.InstanceAttributeValue doesn't take a context itself.
+func fetchInstanceAttribute(ctx context.Context, attr string) (string, bool) {
+	type result struct {
+		value string
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		value, err := metadata.InstanceAttributeValue(attr)
+		done <- result{value: value, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", false
+	case res := <-done:
+		return res.value, res.err == nil
+	}
+}
+
+// detectGCEResource is the fallback for nozzles running directly on a GCE
+// instance (not inside GKE).
+func detectGCEResource(ctx context.Context) (*monitoredres.MonitoredResource, bool) {
+	info, ok := fetchGCEInstanceInfo(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	return &monitoredres.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  info.projectID,
+			"instance_id": info.instanceID,
+			"zone":        info.zone,
+		},
+	}, true
+}
+
+// detectGKEResource identifies a nozzle running as a pod inside GKE: it's on
+// GCE, a Kubernetes service account is mounted, and the instance carries the
+// cluster-name/cluster-location attributes GKE sets on every node. Pod-level
+// details come from the downward API env vars operators are expected to set
+// on the nozzle's container spec (POD_NAMESPACE, POD_NAME, CONTAINER_NAME).
+func detectGKEResource(ctx context.Context) (*monitoredres.MonitoredResource, bool) {
+	if _, err := os.Stat(kubernetesServiceAccountPath); err != nil {
+		return nil, false
+	}
+
+	info, ok := fetchGCEInstanceInfo(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	clusterName, ok := fetchInstanceAttribute(ctx, "cluster-name")
+	if !ok || clusterName == "" {
+		return nil, false
+	}
+	clusterLocation, ok := fetchInstanceAttribute(ctx, "cluster-location")
+	if !ok {
+		clusterLocation = info.zone
+	}
+
+	return &monitoredres.MonitoredResource{
+		Type: "k8s_container",
+		Labels: map[string]string{
+			"project_id":     info.projectID,
+			"location":       clusterLocation,
+			"cluster_name":   clusterName,
+			"namespace_name": os.Getenv("POD_NAMESPACE"),
+			"pod_name":       os.Getenv("POD_NAME"),
+			"container_name": os.Getenv("CONTAINER_NAME"),
+		},
+	}, true
+}
+
+// detectCFResource identifies a nozzle running as an app instance on a CF
+// Diego cell, via the CF_INSTANCE_* env vars Diego sets on every container.
+func detectCFResource(ctx context.Context) (*monitoredres.MonitoredResource, bool) {
+	guid := os.Getenv("CF_INSTANCE_GUID")
+	if guid == "" {
+		return nil, false
+	}
+
+	return &monitoredres.MonitoredResource{
+		Type: "CF",
+		Labels: map[string]string{
+			"cf_instance_guid":  guid,
+			"cf_instance_index": os.Getenv("CF_INSTANCE_INDEX"),
+			"cf_instance_ip":    os.Getenv("CF_INSTANCE_IP"),
+		},
+	}, true
+}
+
+// detectMonitoredResource identifies the Stackdriver MonitoredResource for
+// wherever nozzle is currently running, trying resourceDetectors in order
+// and falling back to "global" if none of them apply. ctx bounds how long
+// any metadata-server lookups are allowed to take.
+func detectMonitoredResource(ctx context.Context) *monitoredres.MonitoredResource {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	for _, detect := range resourceDetectors {
+		if res, ok := detect(ctx); ok {
+			return res
+		}
+	}
+
+	return &monitoredres.MonitoredResource{Type: "global"}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// NewOTLPTelemetrySink dials endpoint and returns a telemetry.Sink that
+// exports nozzle metrics over OTLP gRPC. headers (e.g. an API key) are sent
+// with every Export call. ctx bounds the monitored-resource detection that
+// backs the OTLP resource attributes (see detectMonitoredResource).
+func NewOTLPTelemetrySink(ctx context.Context, logger lager.Logger, endpoint string, headers map[string]string, subscriptionID, foundation string) (telemetry.Sink, error) {
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
+	if err != nil {
+		return nil, fmt.Errorf("dialing OTLP endpoint %s: %w", endpoint, err)
+	}
+
+	client := &headerMetricsExportClient{
+		client: collectorpb.NewMetricsServiceClient(conn),
+		md:     metadata.New(headers),
+	}
+
+	resourceAttrs := monitoredResourceAttributes(detectMonitoredResource(ctx))
+	resourceAttrs["subscription_id"] = subscriptionID
+	resourceAttrs["foundation"] = foundation
+
+	return telemetry.NewOTLPSink(logger, client, resourceAttrs), nil
+}
+
+// headerMetricsExportClient attaches static gRPC metadata (e.g. an API key
+// header) to every Export call.
+type headerMetricsExportClient struct {
+	client collectorpb.MetricsServiceClient
+	md     metadata.MD
+}
+
+func (c *headerMetricsExportClient) Export(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	ctx = metadata.NewOutgoingContext(ctx, c.md)
+	return c.client.Export(ctx, req)
+}
+
+// monitoredResourceAttributes flattens a Stackdriver MonitoredResource into
+// the plain string map telemetry.NewOTLPSink expects, so the same
+// detectMonitoredResource() call backs both exporters.
+func monitoredResourceAttributes(res *monitoredres.MonitoredResource) map[string]string {
+	attrs := map[string]string{"monitored_resource_type": res.GetType()}
+	for k, v := range res.GetLabels() {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// NewTelemetrySinks builds the telemetry.Sink(s) selected by the
+// telemetry.exporter config flag ("stackdriver", "otlp", or "both").
+func NewTelemetrySinks(exporter string, stackdriverSink telemetry.Sink, otlpSink telemetry.Sink) (telemetry.Sink, error) {
+	switch exporter {
+	case "", "stackdriver":
+		return stackdriverSink, nil
+	case "otlp":
+		return otlpSink, nil
+	case "both":
+		return telemetry.NewMultiSink(stackdriverSink, otlpSink), nil
+	default:
+		return nil, fmt.Errorf("unknown telemetry.exporter %q: want stackdriver, otlp, or both", exporter)
+	}
+}
@@ -17,27 +17,53 @@
 package stackdriver
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"time"
 
-	"cloud.google.com/go/compute/metadata"
 	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/genproto/googleapis/api/distribution"
 	"google.golang.org/genproto/googleapis/api/label"
 	"google.golang.org/genproto/googleapis/api/metric"
 	"google.golang.org/genproto/googleapis/api/monitoredres"
 	"google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
+// MetricKindMode selects whether counters are reported as ever-growing
+// CUMULATIVE time series (the default) or as DELTA time series over a
+// rolling window. Long-lived nozzles should prefer Delta: a Cumulative
+// series measured against a StartTime that never moves keeps growing
+// without bound for the lifetime of the process.
+type MetricKindMode int
+
+const (
+	// Cumulative reports every counter against the sink's original
+	// StartTime, matching Stackdriver Monitoring's historical behavior.
+	Cumulative MetricKindMode = iota
+	// Delta reports every counter against a window that advances to "now"
+	// after each Report, so consumers see the change since the last report
+	// rather than the total since nozzle started.
+	Delta
+)
+
 type telemetrySink struct {
 	projectPath string
 	labels      map[string]string
 	resource    *monitoredres.MonitoredResource
 	logger      lager.Logger
 	client      MetricClient
+	mode        MetricKindMode
 	startTime   *timestamp.Timestamp
+
+	// prevValues holds the last-reported cumulative value of each Counter,
+	// so Delta mode can report the increment since the previous Report
+	// instead of the Counter's all-time total. Counter itself stays a plain
+	// monotonic total (see telemetry/counter.go) since other consumers, e.g.
+	// the OTLP sink, need that same cumulative value.
+	prevValues map[*telemetry.Counter]int64
 }
 
 func now() *timestamp.Timestamp {
@@ -48,41 +74,29 @@ func now() *timestamp.Timestamp {
 	}
 }
 
-func detectMonitoredResource() (res *monitoredres.MonitoredResource) {
-	res = &monitoredres.MonitoredResource{Type: "global"}
-
-	if metadata.OnGCE() {
-		projectID, err := metadata.ProjectID()
-		if err != nil {
-			return
-		}
-		instanceID, err := metadata.InstanceID()
-		if err != nil {
-			return
-		}
-		zone, err := metadata.Zone()
-		if err != nil {
-			return
-		}
-
-		res.Type = "gce_instance"
-		res.Labels = map[string]string{"project_id": projectID, "instance_id": instanceID, "zone": zone}
-	}
-	return
-}
-
-// NewTelemetrySink provides a telemetry.Sink that writes metrics to Stackdriver Monitoring
-func NewTelemetrySink(logger lager.Logger, client MetricClient, projectID, subscriptionID, foundation string) telemetry.Sink {
+// NewTelemetrySink provides a telemetry.Sink backend that writes metrics to
+// Stackdriver Monitoring via CreateTimeSeries. It can be combined with other
+// backends (e.g. NewOTLPTelemetrySink) through telemetry.NewMultiSink.
+//
+// The constructor does no I/O; detecting the monitored resource and
+// pre-registering metric descriptors (both of which can block or fail) now
+// happen in Init, so startup failures are surfaced to the caller instead of
+// hanging silently during construction.
+func NewTelemetrySink(logger lager.Logger, client MetricClient, projectID, subscriptionID, foundation string, mode MetricKindMode) telemetry.Sink {
 	return &telemetrySink{
 		logger:      logger,
 		client:      client,
 		projectPath: fmt.Sprintf("projects/%s", projectID),
 		labels:      map[string]string{"subscription_id": subscriptionID, "foundation": foundation},
-		startTime:   now(),
-		resource:    detectMonitoredResource()}
+		mode:        mode,
+		prevValues:  map[*telemetry.Counter]int64{},
+	}
 }
 
-func (ts *telemetrySink) Init(registeredSeries []*expvar.KeyValue) {
+func (ts *telemetrySink) Init(ctx context.Context, registeredSeries []*expvar.KeyValue) error {
+	ts.startTime = now()
+	ts.resource = detectMonitoredResource(ctx)
+
 	req := &monitoring.ListMetricDescriptorsRequest{
 		Name:   ts.projectPath,
 		Filter: fmt.Sprintf(`metric.type = starts_with("stackdriver-nozzle")`),
@@ -90,7 +104,7 @@ func (ts *telemetrySink) Init(registeredSeries []*expvar.KeyValue) {
 
 	descriptors, err := ts.client.ListMetricDescriptors(req)
 	if err != nil {
-		ts.logger.Error("telemetrySink.ListMetricDescriptors", err, lager.Data{"req": req})
+		return fmt.Errorf("telemetrySink.ListMetricDescriptors: %w", err)
 	}
 
 	registered := map[string]bool{}
@@ -122,8 +136,8 @@ func (ts *telemetrySink) Init(registeredSeries []*expvar.KeyValue) {
 				Name:        name,
 				Type:        ts.metricDescriptorType(series.Key),
 				Labels:      labels,
-				MetricKind:  metric.MetricDescriptor_CUMULATIVE,
-				ValueType:   metric.MetricDescriptor_INT64,
+				MetricKind:  ts.metricKind(series.Value),
+				ValueType:   ts.valueType(series.Value),
 				Description: "stackdriver-nozzle created custom metric.",
 			},
 		}
@@ -131,6 +145,22 @@ func (ts *telemetrySink) Init(registeredSeries []*expvar.KeyValue) {
 			ts.logger.Error("telemetrySink.CreateMetricDescriptor", err, lager.Data{"req": req})
 		}
 	}
+
+	return nil
+}
+
+// Run satisfies provider.Provider. telemetrySink has no ongoing work of its
+// own beyond Report, which is driven by the caller's reporting ticker, so
+// Run just blocks until the nozzle shuts down.
+func (ts *telemetrySink) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Close satisfies provider.Provider. telemetrySink holds no resources that
+// need releasing beyond its MetricClient, which the caller owns.
+func (ts *telemetrySink) Close() error {
+	return nil
 }
 
 func (ts *telemetrySink) metricDescriptorName(key string) string {
@@ -141,6 +171,50 @@ func (ts *telemetrySink) metricDescriptorType(key string) string {
 	return fmt.Sprintf("custom.googleapis.com/%s", key)
 }
 
+// metricKind returns the MetricKind a registered expvar should be described
+// as. Gauges are always instantaneous; everything else follows the sink's
+// configured Cumulative/Delta mode.
+func (ts *telemetrySink) metricKind(value interface{}) metric.MetricDescriptor_MetricKind {
+	switch value.(type) {
+	case *telemetry.Gauge:
+		return metric.MetricDescriptor_GAUGE
+	default:
+		return ts.counterMetricKind()
+	}
+}
+
+func (ts *telemetrySink) counterMetricKind() metric.MetricDescriptor_MetricKind {
+	if ts.mode == Delta {
+		return metric.MetricDescriptor_DELTA
+	}
+	return metric.MetricDescriptor_CUMULATIVE
+}
+
+// counterValue returns the value to report for counter: its full cumulative
+// total in Cumulative mode, or the increment since the previous Report in
+// Delta mode.
+func (ts *telemetrySink) counterValue(counter *telemetry.Counter) int64 {
+	current := counter.Value()
+	if ts.mode != Delta {
+		return current
+	}
+
+	delta := current - ts.prevValues[counter]
+	ts.prevValues[counter] = current
+	return delta
+}
+
+func (ts *telemetrySink) valueType(value interface{}) metric.MetricDescriptor_ValueType {
+	switch value.(type) {
+	case *telemetry.Gauge:
+		return metric.MetricDescriptor_DOUBLE
+	case *telemetry.Histogram:
+		return metric.MetricDescriptor_DISTRIBUTION
+	default:
+		return metric.MetricDescriptor_INT64
+	}
+}
+
 const maxTimeSeries = 200
 
 func (ts *telemetrySink) newRequest() *monitoring.CreateTimeSeriesRequest {
@@ -152,9 +226,10 @@ func (ts *telemetrySink) newRequest() *monitoring.CreateTimeSeriesRequest {
 func (ts *telemetrySink) Report(report []*expvar.KeyValue) {
 	req := ts.newRequest()
 
+	endTime := now()
 	interval := &monitoring.TimeInterval{
 		StartTime: ts.startTime,
-		EndTime:   now(),
+		EndTime:   endTime,
 	}
 
 	for _, data := range report {
@@ -173,21 +248,36 @@ func (ts *telemetrySink) Report(report []*expvar.KeyValue) {
 			ts.logger.Error("telemetrySink.Report", err, lager.Data{"req": req})
 		}
 	}
+
+	// In Delta mode each report covers the window since the previous one, so
+	// the window has to advance; Cumulative mode keeps measuring against the
+	// original startTime.
+	if ts.mode == Delta {
+		ts.startTime = endTime
+	}
 }
 
 func (ts *telemetrySink) timeSeries(metricType string, interval *monitoring.TimeInterval, val *expvar.KeyValue) []*monitoring.TimeSeries {
 	switch data := val.Value.(type) {
 	case *telemetry.Counter:
-		return []*monitoring.TimeSeries{ts.timeSeriesInt(metricType, interval, ts.labels, data.Value())}
+		return []*monitoring.TimeSeries{ts.timeSeriesInt(metricType, interval, ts.labels, ts.counterValue(data))}
 	case *telemetry.CounterMap:
 		var series []*monitoring.TimeSeries
 		data.Do(func(value expvar.KeyValue) {
 			if intVal, ok := value.Value.(*telemetry.Counter); ok {
 				labels := merge(ts.labels, intVal.Labels)
-				series = append(series, ts.timeSeriesInt(metricType, interval, labels, intVal.Value()))
+				series = append(series, ts.timeSeriesInt(metricType, interval, labels, ts.counterValue(intVal)))
 			}
 		})
 		return series
+	case *telemetry.Gauge:
+		// GAUGE points must have StartTime == EndTime (or no StartTime at
+		// all); reusing the Cumulative/Delta interval's StartTime here gets
+		// every point rejected by CreateTimeSeries.
+		gaugeInterval := &monitoring.TimeInterval{EndTime: interval.EndTime}
+		return []*monitoring.TimeSeries{ts.timeSeriesDouble(metricType, gaugeInterval, ts.labels, data.Value())}
+	case *telemetry.Histogram:
+		return []*monitoring.TimeSeries{ts.timeSeriesDistribution(metricType, interval, ts.labels, data)}
 	default:
 		ts.logger.Error("telemetrySink.timeSeries", fmt.Errorf("unknown value type: %T", val), lager.Data{"value": val})
 	}
@@ -208,7 +298,7 @@ func merge(a, b map[string]string) map[string]string {
 
 func (ts *telemetrySink) timeSeriesInt(metricType string, interval *monitoring.TimeInterval, labels map[string]string, value int64) *monitoring.TimeSeries {
 	return &monitoring.TimeSeries{
-		MetricKind: metric.MetricDescriptor_CUMULATIVE,
+		MetricKind: ts.counterMetricKind(),
 		ValueType:  metric.MetricDescriptor_INT64,
 		Metric: &metric.Metric{
 			Type:   metricType,
@@ -223,3 +313,54 @@ func (ts *telemetrySink) timeSeriesInt(metricType string, interval *monitoring.T
 		Resource: ts.resource,
 	}
 }
+
+func (ts *telemetrySink) timeSeriesDouble(metricType string, interval *monitoring.TimeInterval, labels map[string]string, value float64) *monitoring.TimeSeries {
+	return &monitoring.TimeSeries{
+		MetricKind: metric.MetricDescriptor_GAUGE,
+		ValueType:  metric.MetricDescriptor_DOUBLE,
+		Metric: &metric.Metric{
+			Type:   metricType,
+			Labels: labels,
+		},
+		Points: []*monitoring.Point{{
+			Interval: interval,
+			Value: &monitoring.TypedValue{
+				Value: &monitoring.TypedValue_DoubleValue{DoubleValue: value},
+			},
+		}},
+		Resource: ts.resource,
+	}
+}
+
+func (ts *telemetrySink) timeSeriesDistribution(metricType string, interval *monitoring.TimeInterval, labels map[string]string, histogram *telemetry.Histogram) *monitoring.TimeSeries {
+	bucketCounts, count, _ := histogram.Snapshot()
+
+	return &monitoring.TimeSeries{
+		MetricKind: ts.metricKind(histogram),
+		ValueType:  metric.MetricDescriptor_DISTRIBUTION,
+		Metric: &metric.Metric{
+			Type:   metricType,
+			Labels: labels,
+		},
+		Points: []*monitoring.Point{{
+			Interval: interval,
+			Value: &monitoring.TypedValue{
+				Value: &monitoring.TypedValue_DistributionValue{
+					DistributionValue: &distribution.Distribution{
+						Count:        count,
+						Mean:         histogram.Mean(),
+						BucketCounts: bucketCounts,
+						BucketOptions: &distribution.Distribution_BucketOptions{
+							Options: &distribution.Distribution_BucketOptions_ExplicitBuckets{
+								ExplicitBuckets: &distribution.Distribution_BucketOptions_Explicit{
+									Bounds: histogram.Bounds,
+								},
+							},
+						},
+					},
+				},
+			},
+		}},
+		Resource: ts.resource,
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing int64 counter. It satisfies
+// expvar.Var so it can be published through the standard expvar registry and
+// picked up by a Sink when reporting.
+type Counter struct {
+	value  int64
+	Labels map[string]string
+}
+
+// NewCounter returns a Counter starting at zero, tagged with labels.
+func NewCounter(labels map[string]string) *Counter {
+	return &Counter{Labels: labels}
+}
+
+// Add increments the counter by delta.
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.value, delta)
+}
+
+// Value returns the counter's current value.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// String implements expvar.Var.
+func (c *Counter) String() string {
+	return strconv.FormatInt(c.Value(), 10)
+}
+
+// CounterMap is a set of Counters keyed by an arbitrary string, e.g. one
+// Counter per firehose origin. LabelKeys names the extra label dimensions
+// carried by the Counters it holds, so a Sink can register matching
+// metric-descriptor labels once up front instead of per Counter.
+type CounterMap struct {
+	LabelKeys []string
+
+	mu       sync.RWMutex
+	counters map[string]*Counter
+}
+
+// NewCounterMap returns an empty CounterMap whose Counters are expected to
+// carry the given label keys.
+func NewCounterMap(labelKeys ...string) *CounterMap {
+	return &CounterMap{LabelKeys: labelKeys, counters: map[string]*Counter{}}
+}
+
+// Get returns the Counter for key, creating it (tagged with labels) if it
+// doesn't exist yet.
+func (m *CounterMap) Get(key string, labels map[string]string) *Counter {
+	m.mu.RLock()
+	c, ok := m.counters[key]
+	m.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok = m.counters[key]; ok {
+		return c
+	}
+	c = NewCounter(labels)
+	m.counters[key] = c
+	return c
+}
+
+// Do calls f for every Counter currently in the map, in the same shape
+// expvar.Do uses, so callers can treat a CounterMap like a nested registry.
+func (m *CounterMap) Do(f func(expvar.KeyValue)) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for key, counter := range m.counters {
+		f(expvar.KeyValue{Key: key, Value: counter})
+	}
+}
+
+// String implements expvar.Var.
+func (m *CounterMap) String() string {
+	return strconv.Itoa(len(m.counters))
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Gauge is a point-in-time float64 value, e.g. "current queue depth" or
+// "ContainerMetric CPU%", as opposed to Counter's monotonically increasing
+// total. It satisfies expvar.Var so it can be published like a Counter.
+type Gauge struct {
+	mu    sync.RWMutex
+	value float64
+}
+
+// NewGauge returns a Gauge starting at zero.
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+// Set overwrites the gauge's current value.
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+// Value returns the gauge's current value.
+func (g *Gauge) Value() float64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.value
+}
+
+// String implements expvar.Var.
+func (g *Gauge) String() string {
+	return strconv.FormatFloat(g.Value(), 'g', -1, 64)
+}
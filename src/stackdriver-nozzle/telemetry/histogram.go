@@ -0,0 +1,109 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Histogram tracks the distribution of observed float64 values across a
+// fixed set of buckets, e.g. firehose ValueMetric/ContainerMetric values
+// (CPU%, memory, disk) that are more useful as a distribution than as an
+// opaque counter.
+//
+// Bounds holds the upper bound of every finite bucket; a value v falls into
+// bucket i where Bounds[i-1] <= v < Bounds[i] (bucket 0 is (-Inf, Bounds[0]),
+// and there's one extra overflow bucket for [Bounds[len-1], +Inf)).
+type Histogram struct {
+	Bounds []float64
+
+	mu      sync.Mutex
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// NewHistogram returns a Histogram with explicit, caller-provided bucket
+// boundaries. bounds must be sorted ascending.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{Bounds: bounds, buckets: make([]int64, len(bounds)+1)}
+}
+
+// NewExponentialHistogram returns a Histogram whose bucket boundaries grow
+// geometrically: scale, scale*base, scale*base^2, ..., numBuckets bounds in
+// all, giving numBuckets+1 buckets counting the overflow bucket. This is a convenient default when a metric's range isn't known
+// up front, e.g. request latency or memory usage.
+func NewExponentialHistogram(numBuckets int, scale, base float64) *Histogram {
+	bounds := make([]float64, numBuckets)
+	bound := scale
+	for i := range bounds {
+		bounds[i] = bound
+		bound *= base
+	}
+	return NewHistogram(bounds)
+}
+
+// Observe records a single value.
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += value
+
+	bucket := len(h.Bounds)
+	for i, bound := range h.Bounds {
+		if value < bound {
+			bucket = i
+			break
+		}
+	}
+	h.buckets[bucket]++
+}
+
+// Snapshot returns the histogram's current bucket counts, total count, and
+// sum, suitable for building a Stackdriver/OTLP distribution point.
+func (h *Histogram) Snapshot() (bucketCounts []int64, count int64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	bucketCounts = make([]int64, len(h.buckets))
+	copy(bucketCounts, h.buckets)
+	return bucketCounts, h.count, h.sum
+}
+
+// Mean returns the mean of all observed values, or 0 if none have been
+// observed yet.
+func (h *Histogram) Mean() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+// String implements expvar.Var.
+func (h *Histogram) String() string {
+	_, count, sum := h.Snapshot()
+	if count == 0 || math.IsNaN(sum) {
+		return fmt.Sprintf("{\"count\":%d}", count)
+	}
+	return fmt.Sprintf("{\"count\":%d,\"sum\":%g}", count, sum)
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+// MetricsExportClient is the subset of collectorpb.MetricsServiceClient that
+// otlpSink needs, so tests can stub it without a real gRPC connection.
+type MetricsExportClient interface {
+	Export(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error)
+}
+
+const otlpScopeName = "stackdriver-nozzle"
+
+// otlpSink exports nozzle telemetry as OTLP metric points over gRPC, so
+// operators can send nozzle metrics to Prometheus/Tempo/Grafana or any other
+// OTLP-compatible backend instead of being locked into Stackdriver Monitoring.
+type otlpSink struct {
+	client    MetricsExportClient
+	resource  *resourcepb.Resource
+	logger    lager.Logger
+	startTime time.Time
+}
+
+// NewOTLPSink returns a telemetry.Sink that ships metrics to an OTLP gRPC
+// endpoint. resourceAttrs is used as given to build the OTLP Resource
+// attached to every point; no labels are added to it here.
+func NewOTLPSink(logger lager.Logger, client MetricsExportClient, resourceAttrs map[string]string) Sink {
+	return &otlpSink{
+		client:    client,
+		resource:  resourceFromAttrs(resourceAttrs),
+		logger:    logger,
+		startTime: time.Now(),
+	}
+}
+
+func resourceFromAttrs(attrs map[string]string) *resourcepb.Resource {
+	resource := &resourcepb.Resource{}
+	for k, v := range attrs {
+		resource.Attributes = append(resource.Attributes, &commonpb.KeyValue{
+			Key:   k,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}},
+		})
+	}
+	return resource
+}
+
+// Init is a no-op for OTLP: unlike Stackdriver Monitoring, collectors don't
+// require metric descriptors to be pre-created before points can be sent.
+func (os *otlpSink) Init(ctx context.Context, registeredSeries []*expvar.KeyValue) error {
+	return nil
+}
+
+// Run satisfies provider.Provider. otlpSink has no ongoing work of its own
+// beyond Report, which is driven by the caller's reporting ticker, so Run
+// just blocks until the nozzle shuts down.
+func (os *otlpSink) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Close satisfies provider.Provider. otlpSink holds no resources that need
+// releasing beyond its MetricsExportClient, which the caller owns.
+func (os *otlpSink) Close() error {
+	return nil
+}
+
+func (os *otlpSink) Report(report []*expvar.KeyValue) {
+	startTime := os.startTime.UnixNano()
+	now := time.Now().UnixNano()
+
+	var metrics []*metricpb.Metric
+	for _, data := range report {
+		metrics = append(metrics, os.metric(data, uint64(startTime), uint64(now))...)
+	}
+
+	if len(metrics) == 0 {
+		return
+	}
+
+	req := &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricpb.ResourceMetrics{{
+			Resource: os.resource,
+			ScopeMetrics: []*metricpb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName},
+				Metrics: metrics,
+			}},
+		}},
+	}
+
+	if _, err := os.client.Export(context.Background(), req); err != nil {
+		os.logger.Error("otlpSink.Export", err, lager.Data{"metrics": len(metrics)})
+	}
+}
+
+func (os *otlpSink) metric(data *expvar.KeyValue, startTime, now uint64) []*metricpb.Metric {
+	switch val := data.Value.(type) {
+	case *Counter:
+		return []*metricpb.Metric{os.sumMetric(data.Key, nil, val.Value(), startTime, now)}
+	case *CounterMap:
+		var metrics []*metricpb.Metric
+		val.Do(func(kv expvar.KeyValue) {
+			if counter, ok := kv.Value.(*Counter); ok {
+				metrics = append(metrics, os.sumMetric(data.Key, counter.Labels, counter.Value(), startTime, now))
+			}
+		})
+		return metrics
+	case *Gauge:
+		return []*metricpb.Metric{os.gaugeMetric(data.Key, val.Value(), now)}
+	case *Histogram:
+		return []*metricpb.Metric{os.histogramMetric(data.Key, val, startTime, now)}
+	default:
+		os.logger.Error("otlpSink.metric", fmt.Errorf("unknown value type: %T", val), lager.Data{"key": data.Key})
+		return nil
+	}
+}
+
+func (os *otlpSink) sumMetric(name string, labels map[string]string, value int64, startTime, now uint64) *metricpb.Metric {
+	var attrs []*commonpb.KeyValue
+	for k, v := range labels {
+		attrs = append(attrs, &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}})
+	}
+
+	return &metricpb.Metric{
+		Name: name,
+		Data: &metricpb.Metric_Sum{
+			Sum: &metricpb.Sum{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+				DataPoints: []*metricpb.NumberDataPoint{{
+					Attributes:        attrs,
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      now,
+					Value:             &metricpb.NumberDataPoint_AsInt{AsInt: value},
+				}},
+			},
+		},
+	}
+}
+
+func (os *otlpSink) gaugeMetric(name string, value float64, now uint64) *metricpb.Metric {
+	return &metricpb.Metric{
+		Name: name,
+		Data: &metricpb.Metric_Gauge{
+			Gauge: &metricpb.Gauge{
+				DataPoints: []*metricpb.NumberDataPoint{{
+					TimeUnixNano: now,
+					Value:        &metricpb.NumberDataPoint_AsDouble{AsDouble: value},
+				}},
+			},
+		},
+	}
+}
+
+func (os *otlpSink) histogramMetric(name string, histogram *Histogram, startTime, now uint64) *metricpb.Metric {
+	snapshotCounts, count, sum := histogram.Snapshot()
+
+	bucketCounts := make([]uint64, len(snapshotCounts))
+	for i, c := range snapshotCounts {
+		bucketCounts[i] = uint64(c)
+	}
+
+	return &metricpb.Metric{
+		Name: name,
+		Data: &metricpb.Metric_Histogram{
+			Histogram: &metricpb.Histogram{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricpb.HistogramDataPoint{{
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      now,
+					Count:             uint64(count),
+					Sum:               &sum,
+					BucketCounts:      bucketCounts,
+					ExplicitBounds:    histogram.Bounds,
+				}},
+			},
+		},
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package telemetry holds the backend-agnostic pieces of nozzle
+// self-telemetry: the Counter/CounterMap types published through expvar, and
+// the Sink interface that ships them somewhere (Stackdriver Monitoring,
+// OTLP, ...).
+package telemetry
+
+import (
+	"context"
+	"expvar"
+	"sync"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/provider"
+)
+
+// Sink is implemented by each telemetry backend that nozzle self-metrics
+// (and optionally firehose-derived metrics) can be shipped to. It embeds
+// provider.Provider so callers can Run/Close a Sink (e.g. one built by
+// NewMultiSink) without an unsafe type assertion; Init pre-creates any
+// metric descriptors the backend needs from every registered expvar, and
+// Report is called on every telemetry tick with the current values.
+type Sink interface {
+	provider.Provider
+	Report(report []*expvar.KeyValue)
+}
+
+// multiSink fans Init/Report out to several backends, e.g. exporter =
+// "both" configures it to report to Stackdriver Monitoring and OTLP at once.
+type multiSink struct {
+	sinks []Sink
+}
+
+// NewMultiSink combines several Sinks into one, so a single telemetry loop
+// can report to all of them.
+func NewMultiSink(sinks ...Sink) Sink {
+	return &multiSink{sinks: sinks}
+}
+
+func (m *multiSink) Init(ctx context.Context, registeredSeries []*expvar.KeyValue) error {
+	for _, sink := range m.sinks {
+		if err := sink.Init(ctx, registeredSeries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multiSink) Report(report []*expvar.KeyValue) {
+	for _, sink := range m.sinks {
+		sink.Report(report)
+	}
+}
+
+// Run satisfies provider.Provider, running every backend concurrently and
+// blocking until they've all returned.
+func (m *multiSink) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(m.sinks))
+
+	for _, sink := range m.sinks {
+		wg.Add(1)
+		go func(s Sink) {
+			defer wg.Done()
+			if err := s.Run(ctx); err != nil {
+				errs <- err
+			}
+		}(sink)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
+	}
+	return nil
+}
+
+// Close satisfies provider.Provider, closing every backend. It keeps going
+// on error so one failing backend doesn't leak another's connection,
+// returning the first error seen.
+func (m *multiSink) Close() error {
+	var first error
+	for _, sink := range m.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}